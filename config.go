@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// readConfig reads a finkles configuration from the disk, considering a
+// command line context. If the configured path is a directory, or a
+// companion "<path-without-ext>.d" directory exists alongside it, every
+// *.yaml/*.yml fragment found is decoded in lexical order and deep-merged
+// into the result, so operators can split node args, genesis allocations,
+// and steps across composable files instead of one giant .finkles.yaml.
+func readConfig(c *cli.Context) (*Config, error) {
+	sources, err := configSources(c.String("config"))
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+
+	for _, source := range sources {
+		fragment, err := decodeConfigFile(source)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := mergeConfig(&cfg, fragment); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cfg, nil
+}
+
+// configSources resolves the ordered list of YAML files that make up a
+// finkles configuration at path: the file (or directory) at path itself,
+// plus any fragments found in a companion "<path-without-ext>.d" directory.
+func configSources(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("no finkles config found in the working directory")
+		}
+
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return configFragments(path)
+	}
+
+	sources := []string{path}
+
+	companion := strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+	if companionInfo, err := os.Stat(companion); err == nil && companionInfo.IsDir() {
+		fragments, err := configFragments(companion)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, fragments...)
+	}
+
+	return sources, nil
+}
+
+// configFragments returns every mergeable *.yaml/*.yml file directly inside
+// dir, in lexical order (the order os.ReadDir already returns entries in).
+func configFragments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var fragments []string
+	for _, entry := range entries {
+		if entry.IsDir() || !isMergeableConfigFile(entry.Name()) {
+			continue
+		}
+
+		fragments = append(fragments, filepath.Join(dir, entry.Name()))
+	}
+
+	return fragments, nil
+}
+
+// isMergeableConfigFile reports whether name should be picked up when
+// merging a config directory: it must look like a YAML file, and not a
+// dotfile or an editor backup.
+func isMergeableConfigFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	for _, suffix := range []string{".bak", ".tmp", "~"} {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+// decodeConfigFile decodes a single YAML file into a Config.
+func decodeConfigFile(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cfg Config
+
+	dec := yaml.NewDecoder(file)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// mergeConfig deep-merges src into dst: scalar fields in src override dst,
+// Steps slices concatenate, and Genesis allocation ranges union (erroring on
+// overlap) rather than overriding outright.
+func mergeConfig(dst *Config, src *Config) error {
+	if err := mergeScriptConfig(&dst.ScriptConfig, &src.ScriptConfig); err != nil {
+		return err
+	}
+
+	if src.Test != nil {
+		if dst.Test == nil {
+			dst.Test = &ScriptConfig{}
+		}
+
+		if err := mergeScriptConfig(dst.Test, src.Test); err != nil {
+			return err
+		}
+	}
+
+	if src.Spawn != nil {
+		if dst.Spawn == nil {
+			dst.Spawn = &ScriptConfig{}
+		}
+
+		if err := mergeScriptConfig(dst.Spawn, src.Spawn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeScriptConfig deep-merges src into dst in place.
+func mergeScriptConfig(dst *ScriptConfig, src *ScriptConfig) error {
+	if src == nil {
+		return nil
+	}
+
+	if src.Nodes != nil {
+		if dst.Nodes == nil {
+			dst.Nodes = src.Nodes
+		} else {
+			if src.Nodes.N != 0 {
+				dst.Nodes.N = src.Nodes.N
+			}
+			if src.Nodes.Args != nil {
+				dst.Nodes.Args = src.Nodes.Args
+			}
+			if src.Nodes.Callback != nil {
+				dst.Nodes.Callback = src.Nodes.Callback
+			}
+			if src.Nodes.Restart != nil {
+				dst.Nodes.Restart = src.Nodes.Restart
+			}
+			if src.Nodes.Health != nil {
+				dst.Nodes.Health = src.Nodes.Health
+			}
+		}
+	}
+
+	if src.DataDir != nil {
+		dst.DataDir = src.DataDir
+	}
+
+	if src.Drain != nil {
+		dst.Drain = src.Drain
+	}
+
+	if src.Steps != nil {
+		if dst.Steps == nil {
+			dst.Steps = src.Steps
+		} else {
+			merged := append(*dst.Steps, *src.Steps...)
+			dst.Steps = &merged
+		}
+	}
+
+	if src.Genesis != nil {
+		if dst.Genesis == nil {
+			dst.Genesis = &GenesisConfig{}
+		}
+
+		if err := unionGenesis(dst.Genesis, *src.Genesis); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unionGenesis appends each range in src to dst, erroring if it overlaps
+// with a range already in dst.
+func unionGenesis(dst *GenesisConfig, src GenesisConfig) error {
+	for _, added := range src {
+		for _, existing := range *dst {
+			if added.StartNode < existing.EndNode && existing.StartNode < added.EndNode {
+				return fmt.Errorf("genesis: range [%d, %d) conflicts with range [%d, %d) from an earlier config file", added.StartNode, added.EndNode, existing.StartNode, existing.EndNode)
+			}
+		}
+
+		*dst = append(*dst, added)
+	}
+
+	return nil
+}
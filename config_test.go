@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestUnionGenesisAppendsNonOverlappingRanges(t *testing.T) {
+	dst := &GenesisConfig{{StartNode: 0, EndNode: 2, Amount: big.NewInt(1)}}
+	src := GenesisConfig{{StartNode: 2, EndNode: 4, Amount: big.NewInt(2)}}
+
+	if err := unionGenesis(dst, src); err != nil {
+		t.Fatalf("unionGenesis() error = %v", err)
+	}
+
+	if len(*dst) != 2 {
+		t.Fatalf("len(*dst) = %d, want 2", len(*dst))
+	}
+}
+
+func TestUnionGenesisRejectsOverlappingRanges(t *testing.T) {
+	dst := &GenesisConfig{{StartNode: 0, EndNode: 4, Amount: big.NewInt(1)}}
+	src := GenesisConfig{{StartNode: 2, EndNode: 6, Amount: big.NewInt(2)}}
+
+	if err := unionGenesis(dst, src); err == nil {
+		t.Fatal("unionGenesis() error = nil, want a conflict error")
+	}
+
+	if len(*dst) != 1 {
+		t.Fatalf("len(*dst) = %d, want 1 (rejected range must not be appended)", len(*dst))
+	}
+}
+
+func TestMergeScriptConfigOverridesScalars(t *testing.T) {
+	dataDirA, dataDirB := "a", "b"
+	dst := &ScriptConfig{DataDir: &dataDirA}
+	src := &ScriptConfig{DataDir: &dataDirB}
+
+	if err := mergeScriptConfig(dst, src); err != nil {
+		t.Fatalf("mergeScriptConfig() error = %v", err)
+	}
+
+	if dst.DataDir == nil || *dst.DataDir != dataDirB {
+		t.Fatalf("dst.DataDir = %v, want %q", dst.DataDir, dataDirB)
+	}
+}
+
+func TestMergeScriptConfigConcatenatesSteps(t *testing.T) {
+	a := []string{"step-a"}
+	b := []string{"step-b"}
+	dst := &ScriptConfig{Steps: &a}
+	src := &ScriptConfig{Steps: &b}
+
+	if err := mergeScriptConfig(dst, src); err != nil {
+		t.Fatalf("mergeScriptConfig() error = %v", err)
+	}
+
+	want := []string{"step-a", "step-b"}
+	if len(*dst.Steps) != len(want) || (*dst.Steps)[0] != want[0] || (*dst.Steps)[1] != want[1] {
+		t.Fatalf("*dst.Steps = %v, want %v", *dst.Steps, want)
+	}
+}
+
+func TestMergeScriptConfigUnionsGenesisAndReportsConflicts(t *testing.T) {
+	dst := &ScriptConfig{Genesis: &GenesisConfig{{StartNode: 0, EndNode: 2, Amount: big.NewInt(1)}}}
+	union := &ScriptConfig{Genesis: &GenesisConfig{{StartNode: 2, EndNode: 4, Amount: big.NewInt(3)}}}
+	src := &ScriptConfig{Genesis: &GenesisConfig{{StartNode: 1, EndNode: 3, Amount: big.NewInt(2)}}}
+
+	if err := mergeScriptConfig(dst, union); err != nil {
+		t.Fatalf("mergeScriptConfig() error = %v", err)
+	}
+
+	if len(*dst.Genesis) != 2 {
+		t.Fatalf("len(*dst.Genesis) = %d, want 2", len(*dst.Genesis))
+	}
+
+	if err := mergeScriptConfig(dst, src); err == nil {
+		t.Fatal("mergeScriptConfig() error = nil, want a genesis conflict error")
+	}
+}
+
+func TestMergeConfigMergesSpawnAndTestScripts(t *testing.T) {
+	dataDir := "spawn-dir"
+	testDataDir := "test-dir"
+
+	dst := &Config{}
+	src := &Config{Spawn: &ScriptConfig{DataDir: &dataDir}, Test: &ScriptConfig{DataDir: &testDataDir}}
+
+	if err := mergeConfig(dst, src); err != nil {
+		t.Fatalf("mergeConfig() error = %v", err)
+	}
+
+	if dst.Spawn == nil || dst.Spawn.DataDir == nil || *dst.Spawn.DataDir != dataDir {
+		t.Fatalf("dst.Spawn = %+v, want DataDir %q", dst.Spawn, dataDir)
+	}
+
+	if dst.Test == nil || dst.Test.DataDir == nil || *dst.Test.DataDir != testDataDir {
+		t.Fatalf("dst.Test = %+v, want DataDir %q", dst.Test, testDataDir)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GenesisAllocation maps the hex-encoded public key of a node to the
+// number of coins it is allocated in the genesis block.
+type GenesisAllocation map[string]*big.Int
+
+// prepareGenesis resolves this script's genesis allocation (if any) and
+// materializes it to <dataDir>/genesis.json, returning the path to the
+// resulting file so that it can be passed to smcd via --genesis. If no
+// genesis block has been configured, it returns an empty path.
+func (cfg *ScriptConfig) prepareGenesis(dataDir string, n uint64) (string, error) {
+	if cfg.Genesis == nil {
+		return "", nil
+	}
+
+	alloc, err := resolveGenesis(cfg.Genesis, dataDir, n)
+	if err != nil {
+		return "", err
+	}
+
+	return writeGenesisFile(dataDir, alloc)
+}
+
+// resolveGenesis validates the ranges declared in a GenesisConfig against
+// the number of nodes being spawned, then queries each node's public key
+// from smcd and returns the resolved allocation table.
+func resolveGenesis(cfg *GenesisConfig, dataDir string, n uint64) (GenesisAllocation, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	// Track which nodes have already been claimed by an earlier range, so
+	// that we can catch overlapping ranges
+	claimed := make(map[uint64]bool)
+
+	alloc := make(GenesisAllocation)
+
+	for _, rng := range *cfg {
+		if rng.StartNode >= rng.EndNode {
+			return nil, fmt.Errorf("genesis: range [%d, %d) is empty or inverted", rng.StartNode, rng.EndNode)
+		}
+
+		if rng.EndNode > n {
+			return nil, fmt.Errorf("genesis: range [%d, %d) exceeds the %d nodes being spawned", rng.StartNode, rng.EndNode, n)
+		}
+
+		for i := rng.StartNode; i < rng.EndNode; i++ {
+			if claimed[i] {
+				return nil, fmt.Errorf("genesis: node %d is allocated by more than one range", i)
+			}
+			claimed[i] = true
+
+			pubkey, err := nodePublicKey(dataDir, i)
+			if err != nil {
+				return nil, err
+			}
+
+			alloc[pubkey] = rng.Amount
+		}
+	}
+
+	return alloc, nil
+}
+
+// nodeDataDir returns the data directory node i is (or will be) run against,
+// so that it can be queried for its identity before it is spawned, and so
+// that it is actually spawned against that same directory in Start.
+func nodeDataDir(dataDir string, i uint64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("node-%d", i))
+}
+
+// nodePublicKey queries smcd for the public key that node i will use, so
+// that it can be allocated coins in the genesis block.
+func nodePublicKey(dataDir string, i uint64) (string, error) {
+	out, err := exec.Command("smcd", "--identity", "--data-dir", nodeDataDir(dataDir, i)).Output()
+	if err != nil {
+		return "", fmt.Errorf("could not determine public key for node %d: %w", i, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// writeGenesisFile writes a resolved genesis allocation to
+// <dataDir>/genesis.json, creating dataDir if it does not already exist.
+func writeGenesisFile(dataDir string, alloc GenesisAllocation) (string, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dataDir, "genesis.json")
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(alloc); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLogFileSize is the size, in bytes, at which a per-node log file is
+// rotated (renamed to a ".1" suffix, overwriting any previous one) rather
+// than allowed to grow without bound.
+const maxLogFileSize = 10 * 1024 * 1024 // 10MiB
+
+// tailPollInterval is how often a Follower checks a log file for new data
+// while following it.
+const tailPollInterval = 500 * time.Millisecond
+
+// LogSink receives every line a supervised component writes to stdout or
+// stderr, tagging it with which node, role, and pid it came from.
+type LogSink interface {
+	Write(node uint64, role string, pid int, stream string, line string)
+}
+
+// LogCollector is a logrus-based LogSink that writes each node's output to
+// its own rotated file under <dataDir>/logs/node-N.log, and echoes it to an
+// aggregate stream: colored human-readable lines on stderr by default, or
+// logrus JSON on stdout (for consumption by a log shipper) if constructed
+// with jsonOutput.
+type LogCollector struct {
+	dataDir string
+
+	mu     sync.Mutex
+	files  map[uint64]*rotatingFile
+	logger *log.Logger
+}
+
+// NewLogCollector creates a LogCollector that writes per-node log files
+// under <dataDir>/logs.
+func NewLogCollector(dataDir string, jsonOutput bool) *LogCollector {
+	aggregate := io.Writer(os.Stderr)
+
+	logger := log.New()
+	logger.SetFormatter(&log.TextFormatter{ForceColors: true})
+
+	if jsonOutput {
+		aggregate = os.Stdout
+		logger.SetFormatter(&log.JSONFormatter{})
+	}
+
+	logger.SetOutput(aggregate)
+
+	return &LogCollector{dataDir: dataDir, files: make(map[uint64]*rotatingFile), logger: logger}
+}
+
+// Write implements LogSink.
+func (lc *LogCollector) Write(node uint64, role string, pid int, stream string, line string) {
+	lc.logger.WithFields(log.Fields{"node": node, "role": role, "pid": pid, "stream": stream}).Info(line)
+
+	f, err := lc.fileFor(node)
+	if err != nil {
+		lc.logger.WithError(err).WithField("node", node).Warn("failed to open node log file")
+		return
+	}
+
+	fmt.Fprintf(f, "%s [%s:%d] %s\n", stream, role, pid, line)
+}
+
+// fileFor returns the rotating log file for node, opening it if this is the
+// first line captured for that node.
+func (lc *LogCollector) fileFor(node uint64) (*rotatingFile, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if f, ok := lc.files[node]; ok {
+		return f, nil
+	}
+
+	dir := filepath.Join(lc.dataDir, "logs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := newRotatingFile(nodeLogPath(lc.dataDir, node))
+	if err != nil {
+		return nil, err
+	}
+
+	lc.files[node] = f
+
+	return f, nil
+}
+
+// Close closes every per-node log file the collector has opened.
+func (lc *LogCollector) Close() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var firstErr error
+
+	for _, f := range lc.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// nodeLogPath returns the path a node's per-node log file is (or will be)
+// written to under dataDir.
+func nodeLogPath(dataDir string, index uint64) string {
+	return filepath.Join(dataDir, "logs", fmt.Sprintf("node-%d.log", index))
+}
+
+// rotatingFile is an io.WriteCloser that rotates the underlying file (to a
+// ".1" suffix, overwriting any previous one) once it grows past
+// maxLogFileSize.
+type rotatingFile struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &rotatingFile{path: path, file: f, size: info.Size()}, nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size+int64(len(p)) > maxLogFileSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// rotate closes the current file, renames it to a ".1" suffix (clobbering
+// any previous one), and opens a fresh file at the original path.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	rf.file = f
+	rf.size = 0
+
+	return nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.file.Close()
+}
+
+// Follower tails a single log file, transparently handling the rotation
+// rotatingFile performs: if the file shrinks or is replaced with a new
+// inode at the same path, the Follower reopens it from the start rather
+// than seeking past the end of a file that no longer exists.
+type Follower struct {
+	path string
+}
+
+// NewFollower creates a Follower for the log file at path.
+func NewFollower(path string) *Follower {
+	return &Follower{path: path}
+}
+
+// Tail writes path's contents to w. If follow is true, it keeps polling for
+// new lines (and rotation) until ctx is canceled; otherwise it returns once
+// the file's current contents have been written.
+func (fl *Follower) Tail(ctx context.Context, w io.Writer, follow bool) error {
+	file, ino, err := fl.open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+
+	for {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		// The open file keeps its inode after a rotation renames it away, so
+		// the path is stat'ed too to see whether a new file has replaced it
+		pathInfo, pathErr := os.Stat(fl.path)
+		rotated := pathErr == nil && inode(pathInfo) != ino
+
+		if info.Size() < offset || rotated {
+			file.Close()
+
+			file, ino, err = fl.open()
+			if err != nil {
+				return err
+			}
+
+			offset = 0
+
+			continue
+		}
+
+		if info.Size() > offset {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+
+			n, err := io.Copy(w, file)
+			offset += n
+			if err != nil {
+				return err
+			}
+		}
+
+		if !follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tailPollInterval):
+		}
+	}
+}
+
+func (fl *Follower) open() (*os.File, uint64, error) {
+	f, err := os.Open(fl.path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, inode(info), nil
+}
+
+// inode returns the underlying inode number for info, or 0 if it cannot be
+// determined (e.g. on a platform without syscall.Stat_t).
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+
+	return 0
+}
+
+// prefixWriter writes each line written to it through to w, prefixed with a
+// label. Used by tailAllNodes to keep multiplexed per-node log output
+// attributable to the node it came from.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+}
+
+func (pw prefixWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if _, err := fmt.Fprintf(pw.w, "%s: %s\n", pw.prefix, line); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// tailAllNodes tails every per-node log file under dataDir/logs
+// concurrently, prefixing each line with which node it came from.
+func tailAllNodes(dataDir string, follow bool) error {
+	dir := filepath.Join(dataDir, "logs")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("no node log files found; has the swarm been spawned yet?")
+		}
+
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		prefix := strings.TrimSuffix(entry.Name(), ".log")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := prefixWriter{prefix: prefix, w: os.Stdout}
+			if err := NewFollower(path).Tail(context.Background(), w, follow); err != nil {
+				log.WithError(err).WithField("file", path).Warn("failed to tail node log file")
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return nil
+}
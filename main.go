@@ -1,16 +1,18 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"math/big"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
-	"gopkg.in/yaml.v2"
 )
 
 // DefaultNumNodes is the default number of nodes that should be spawned in
@@ -32,18 +34,29 @@ type ScriptConfig struct {
 		N        uint64    // The number of nodes to spawn
 		Args     *[]string // Any arguments that should be passed to the nodes
 		Callback *string   // The name of a script that will be run each time a node has been spawned
+		Restart  *string   // The restart policy to apply to each node: "always", "on-failure" (the default), or "never"
+		Health   *struct {
+			Addr     *string // A host:port to TCP-probe for liveness, independent of whether the node's process has died
+			Interval *string // How often to run the probe, e.g. "10s"; defaults to 10s
+		}
 	}
-	DataDir *string   // A directory in which all of the SMCd data will be placed
-	Steps   *[]string // Any commands that should be run after spawning the nodes
+	DataDir *string        // A directory in which all of the SMCd data will be placed
+	Steps   *[]string      // Any commands that should be run after spawning the nodes
+	Genesis *GenesisConfig // The allocation of coins to make in the network's genesis block
+	Drain   *string        // How long supervised nodes are given to shut down gracefully before being killed, e.g. "10s"; defaults to 10s
 }
 
 // State represents the state of the finkles coordinator
 type State struct {
-	Workers []exec.Cmd // Each of the nodes spawned by the script
+	Supervisor *Supervisor // The supervisor managing the lifecycle of this script's nodes
 }
 
-// Start starts the script, but does not wait for it to finish.
-func (cfg *ScriptConfig) Start() (*State, error) {
+// Start starts the script, but does not wait for it to finish. Lifecycle
+// management (restarts, health checks, graceful shutdown) is delegated to a
+// Supervisor; the returned State lets the caller observe or stop it. If
+// jsonLogs is true, the swarm's aggregate node output is emitted as logrus
+// JSON to stdout instead of colored lines to stderr.
+func (cfg *ScriptConfig) Start(jsonLogs bool) (*State, error) {
 	// The number of nodes we'll spawn. If this value
 	// has not been overridden by the configuration, use 8 as the default
 	n := uint64(DefaultNumNodes)
@@ -53,9 +66,6 @@ func (cfg *ScriptConfig) Start() (*State, error) {
 		n = cfg.Nodes.N
 	}
 
-	// Declare a state buffer that we can store worker info in
-	var state State
-
 	// Check if we are in a rust project directory
 	_, err := os.Stat("cargo.toml")
 
@@ -70,111 +80,197 @@ func (cfg *ScriptConfig) Start() (*State, error) {
 		}
 	}
 
-	// The multiaddr and peer ID of the network's bootstrap node
-	var bootstrapNode []string
+	// The directory that all of this script's SMCd data will be placed in
+	dataDir := "."
+	if cfg.DataDir != nil {
+		dataDir = *cfg.DataDir
+	}
 
-	log.WithFields(log.Fields{"n": n}).Info("Spawning a swarm of SummerCash nodes")
+	// Resolve the genesis allocation (if any has been configured) and
+	// materialize it to disk before spawning any nodes, so that a bad
+	// range is caught up front rather than after the bootstrap node is
+	// already running
+	genesisPath, err := cfg.prepareGenesis(dataDir, n)
+	if err != nil {
+		return nil, err
+	}
+
+	// How long a node is given to shut down gracefully (via SIGTERM) before
+	// the supervisor kills it outright
+	drainTimeout := 10 * time.Second
+	if cfg.Drain != nil {
+		drainTimeout, err = time.ParseDuration(*cfg.Drain)
+		if err != nil {
+			return nil, fmt.Errorf("drain: %w", err)
+		}
+	}
 
-	// Spawn each of the nodes
-	for i := uint64(0); i < n; i++ {
-		// If i is less than the number of bootstrap nodes we need to make,
-		// make this node a bootstrap node
-		if bootstrapNode == nil {
-			log.Info("Starting a bootstrap node for the swarm")
+	// The restart policy, extra args, and health check shared by every node
+	// spawned by this script. These are read out of cfg up front and copied
+	// into the closures below, rather than captured by reference, so that
+	// the supervisor's components can't race with any later mutation of cfg.
+	policy := RestartOnFailure
+	var nodeArgs []string
+	var health *HealthCheck
 
-			// Start the bootstrap node
-			cmd := exec.Command("smcd", "-n")
+	if cfg.Nodes != nil {
+		if cfg.Nodes.Restart != nil {
+			policy = RestartPolicy(*cfg.Nodes.Restart)
+		}
 
-			// Logs from the bootstrap node
-			output, err := cmd.StderrPipe()
-			if err != nil {
-				return nil, err
-			}
+		if cfg.Nodes.Args != nil {
+			nodeArgs = append(nodeArgs, (*cfg.Nodes.Args)...)
+		}
 
-			// Make a reader that we can use to analyze the output of the bp
-			reader := bufio.NewReader(output)
+		if cfg.Nodes.Health != nil {
+			health = &HealthCheck{}
 
-			// Start the bootstrap node
-			if err := cmd.Start(); err != nil {
-				return nil, err
+			if cfg.Nodes.Health.Addr != nil {
+				health.Addr = *cfg.Nodes.Health.Addr
 			}
 
-			for {
-				lineBytes, _, err := reader.ReadLine()
+			if cfg.Nodes.Health.Interval != nil {
+				health.Interval, err = time.ParseDuration(*cfg.Nodes.Health.Interval)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("health: %w", err)
 				}
+			}
+		}
+	}
 
-				// We want to work with this line as a string, since
-				// the smcd cli only outputs human readable information
-				line := string(lineBytes)
+	supervisor := NewSupervisor(dataDir, drainTimeout, NewLogCollector(dataDir, jsonLogs))
+	wireCallbackHook(supervisor, cfg, dataDir)
+
+	// bootstrapNode accumulates the bootstrap component's peer ID and
+	// multiaddr as its scrape goroutine finds them; it is owned entirely by
+	// that goroutine; bootstrapPeerID and bootstrapMultiaddr are the values
+	// copied out of it once both are known, for the peer-spawn loop below to
+	// read. The scrape goroutine keeps running for the life of the
+	// bootstrap process (e.g. it may see further matching log lines from
+	// later peer connections), so bootstrapReady being closed also disables
+	// further appends to bootstrapNode, rather than leaving the peer-spawn
+	// loop to race a goroutine that's still free to mutate it.
+	var bootstrapNode []string
+	var bootstrapPeerID, bootstrapMultiaddr string
+	bootstrapReady := make(chan struct{})
+	var closeBootstrapReady sync.Once
 
-				// If this line is telling us what the peerID
-				// of the bootstrap node is, store this in the
-				// bp metadata var
-				if strings.Contains(line, "peer ID") {
-					bootstrapNode = append(bootstrapNode, strings.Split(line, "peer ID: ")[1])
-				}
+	bootstrapArgs := append([]string{"-n", "--data-dir", nodeDataDir(dataDir, 0)}, nodeArgs...)
+	if genesisPath != "" {
+		bootstrapArgs = append(bootstrapArgs, "--genesis", genesisPath)
+	}
 
-				// If we have not yet determined what the multiaddr of the bootstrap node is
-				// and this node contains this information, store it in the bootstrap node
-				// slice
-				if strings.Contains(line, "Assigned to new address") && len(bootstrapNode) < 2 {
-					bootstrapNode = append(bootstrapNode, strings.Split(strings.Split(line, "Assigned to new address; listening on ")[1], " now")[0])
-				}
+	log.WithFields(log.Fields{"n": n}).Info("Spawning a swarm of SummerCash nodes")
+	log.Info("Starting a bootstrap node for the swarm")
+
+	// The bootstrap node's component scrapes its own stderr for its peer ID
+	// and multiaddr on a dedicated goroutine (see Supervisor.Add), so this
+	// never blocks the supervisor's restart loop for this or any other node
+	supervisor.Add(0, "bootstrap", nodeArgs, policy, health, func() *exec.Cmd {
+		return exec.Command("smcd", bootstrapArgs...)
+	}, func(line string) {
+		// Once bootstrapPeerID/bootstrapMultiaddr have been published (and
+		// bootstrapReady closed), ignore any further announce lines instead
+		// of continuing to mutate bootstrapNode underneath the peer-spawn
+		// loop that may be reading from it
+		select {
+		case <-bootstrapReady:
+			return
+		default:
+		}
 
-				// If we have determined what we need from the bootstrap node logs,
-				// exit
-				if len(bootstrapNode) >= 2 {
-					break
-				}
-			}
+		// If this line is telling us what the peer ID of the bootstrap node
+		// is, store this in the bootstrap node metadata slice
+		if strings.Contains(line, "peer ID") {
+			bootstrapNode = append(bootstrapNode, strings.Split(line, "peer ID: ")[1])
 		}
 
-		// Use the network's bootstrap node
-		//args = append(args, "--bootstrap-peer-id", bootstrapNode[0], "--bootstrap-peer-addr", bootstrapNode[1])
+		// If we have not yet determined what the multiaddr of the bootstrap
+		// node is and this line contains this information, store it too
+		if strings.Contains(line, "Assigned to new address") && len(bootstrapNode) < 2 {
+			bootstrapNode = append(bootstrapNode, strings.Split(strings.Split(line, "Assigned to new address; listening on ")[1], " now")[0])
+		}
 
-		//cmd := exec.Command("smcd")
+		// If we have determined what we need from the bootstrap node logs,
+		// copy them out of bootstrapNode before anyone else can read them,
+		// record them against the supervisor's bootstrap component (so that
+		// `finkles apply` can later point new peers at it), and let Start
+		// know it can wire up the rest of the swarm
+		if len(bootstrapNode) >= 2 {
+			bootstrapPeerID, bootstrapMultiaddr = bootstrapNode[0], bootstrapNode[1]
+			supervisor.SetPeerInfo(0, bootstrapPeerID, bootstrapMultiaddr)
+			closeBootstrapReady.Do(func() { close(bootstrapReady) })
+		}
+	})
+
+	supervisor.Start()
+
+	// Wait for the bootstrap node to announce itself before spawning nodes
+	// that depend on its address. This blocks Start, not the supervisor. If
+	// the bootstrap component instead stops for good first - e.g. it exits
+	// clean under an on-failure policy, or exhausts its restart budget -
+	// bail out with an error instead of hanging forever.
+	select {
+	case <-bootstrapReady:
+	case <-supervisor.Done(0):
+		return nil, fmt.Errorf("bootstrap node stopped (state: %s) before announcing its peer ID; see its logs for why it failed to start", supervisor.Status()[0].State)
+	}
+
+	// Spawn the rest of the swarm, pointed at the bootstrap node
+	for i := uint64(1); i < n; i++ {
+		peerArgs := append([]string{"--bootstrap-peer-id", bootstrapPeerID, "--bootstrap-peer-addr", bootstrapMultiaddr, "--data-dir", nodeDataDir(dataDir, i)}, nodeArgs...)
+		if genesisPath != "" {
+			peerArgs = append(peerArgs, "--genesis", genesisPath)
+		}
 
-		//state.Workers = append(state.Workers)
+		supervisor.Add(i, "peer", nodeArgs, policy, health, func() *exec.Cmd {
+			return exec.Command("smcd", peerArgs...)
+		}, nil)
 	}
 
-	// Allow the caller to continue using the "state" of the command
-	return &state, nil
+	return &State{Supervisor: supervisor}, nil
 }
 
-// Config represents a configuration for the finkles command line utility.
-type Config struct {
-	ScriptConfig `yaml:",inline"` // A global configuration
+// wireCallbackHook configures supervisor to run cfg.Nodes.Callback (if one
+// is configured) each time a node starts, passing the node's index, role,
+// pid, and per-node log file path as environment variables so the script
+// can make post-spawn assertions against the node's log content.
+func wireCallbackHook(supervisor *Supervisor, cfg *ScriptConfig, dataDir string) {
+	if cfg.Nodes == nil || cfg.Nodes.Callback == nil {
+		return
+	}
 
-	Test *ScriptConfig // A script used to test SMCd
+	callback := *cfg.Nodes.Callback
 
-	Spawn *ScriptConfig // A script used to deploy / spawn a node swarm
+	supervisor.SetStartHook(func(index uint64, role string, pid int) {
+		runCallback(callback, index, role, pid, nodeLogPath(dataDir, index))
+	})
 }
 
-// readConfig reads a finkles configuration from the disk, considering a command line context.
-func readConfig(c *cli.Context) (*Config, error) {
-	// Read the configuration file
-	file, err := os.Open(c.String("config"))
-	if err != nil {
-		// Make sure that the user knows no finkles config exists
-		if strings.Contains(err.Error(), "no such file or directory") {
-			return nil, errors.New("no finkles config found in the working directory")
-		}
-
-		return nil, err
+// runCallback runs a node's callback script, reporting (but not otherwise
+// acting on) a non-zero exit so that a failing assertion doesn't take the
+// rest of the swarm down with it.
+func runCallback(script string, index uint64, role string, pid int, logPath string) {
+	cmd := exec.Command(script)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("FINKLES_NODE_INDEX=%d", index),
+		fmt.Sprintf("FINKLES_NODE_ROLE=%s", role),
+		fmt.Sprintf("FINKLES_NODE_PID=%d", pid),
+		fmt.Sprintf("FINKLES_LOG_PATH=%s", logPath),
+	)
+
+	if err := cmd.Run(); err != nil {
+		log.WithFields(log.Fields{"node": index, "callback": script}).WithError(err).Warn("node callback failed")
 	}
-	defer file.Close()
+}
 
-	// The configuration file that the user has provided to us
-	var cfg Config
+// Config represents a configuration for the finkles command line utility.
+type Config struct {
+	ScriptConfig `yaml:",inline"` // A global configuration
 
-	// Make a decoder so that we can take the configuration file and convert it
-	// into structured data
-	dec := yaml.NewDecoder(file)
+	Test *ScriptConfig // A script used to test SMCd
 
-	// Read from the file into the configuration buffer
-	return &cfg, dec.Decode(&cfg)
+	Spawn *ScriptConfig // A script used to deploy / spawn a node swarm
 }
 
 func main() {
@@ -194,6 +290,12 @@ func main() {
 				Name:    "spawn",
 				Aliases: []string{"s"},
 				Usage:   "spawns a SummerCash cluster from the provided configuration file",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json-logs",
+						Usage: "emit aggregate node output as logrus JSON to stdout, instead of colored lines to stderr",
+					},
+				},
 				Action: func(c *cli.Context) error {
 					// Read the configuration file from the disk
 					cfg, err := readConfig(c)
@@ -212,11 +314,15 @@ func main() {
 					}
 
 					// Start the script
-					_, err = script.Start()
+					state, err := script.Start(c.Bool("json-logs"))
 					if err != nil {
 						return err
 					}
 
+					// Keep running, supervising the swarm, until it's shut down
+					// (e.g. by a SIGINT/SIGTERM, which the supervisor handles itself)
+					state.Supervisor.Wait()
+
 					return nil
 				},
 			},
@@ -238,6 +344,170 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "genesis",
+				Usage: "dumps the resolved genesis allocation table without starting the network",
+				Action: func(c *cli.Context) error {
+					// Read the configuration file from the disk
+					cfg, err := readConfig(c)
+					if err != nil {
+						return err
+					}
+
+					// The script whose genesis block we'll resolve. Since "genesis" is a
+					// generalized command, the global config, as well as the spawn config
+					// can be used for this command
+					script := cfg.Spawn
+
+					if script == nil || script.Nodes == nil {
+						// Use the config's global config
+						script = &cfg.ScriptConfig
+					}
+
+					if script.Genesis == nil {
+						return errors.New("configuration file does not contain a genesis allocation")
+					}
+
+					// The number of nodes that'll be spawned, and thus the number of
+					// nodes the genesis allocation can reference
+					n := uint64(DefaultNumNodes)
+					if script.Nodes != nil {
+						n = script.Nodes.N
+					}
+
+					// The directory that node identities will be queried from
+					dataDir := "."
+					if script.DataDir != nil {
+						dataDir = *script.DataDir
+					}
+
+					alloc, err := resolveGenesis(script.Genesis, dataDir, n)
+					if err != nil {
+						return err
+					}
+
+					for pubkey, amount := range alloc {
+						fmt.Printf("%s\t%s\n", pubkey, amount.String())
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "apply",
+				Usage: "reconciles a running swarm against the desired configuration, spawning, stopping, and restarting nodes as needed",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print the reconciliation plan without executing it",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					// Read the configuration file from the disk
+					cfg, err := readConfig(c)
+					if err != nil {
+						return err
+					}
+
+					// The script whose topology we'll reconcile. Since "apply" is a
+					// generalized command, the global config, as well as the spawn
+					// config can be used for this command
+					script := cfg.Spawn
+
+					if script == nil || script.Nodes == nil {
+						// Use the config's global config
+						script = &cfg.ScriptConfig
+					}
+
+					// The directory the swarm's persisted state is read from, and
+					// that any newly-spawned nodes' state will be written to
+					dataDir := "."
+					if script.DataDir != nil {
+						dataDir = *script.DataDir
+					}
+
+					state, err := readSwarmState(dataDir)
+					if err != nil {
+						return err
+					}
+
+					plan := PlanSwarm(desiredNodes(script), state.Nodes)
+
+					if c.Bool("dry-run") {
+						printPlan(plan)
+						return nil
+					}
+
+					if plan.Empty() {
+						log.Info("swarm already matches the desired configuration")
+						return nil
+					}
+
+					// The swarm's existing bootstrap node, if any, that newly
+					// spawned or restarted peers should point at
+					var bootstrap ActualNode
+					for _, node := range state.Nodes {
+						if node.Index == 0 {
+							bootstrap = node
+						}
+					}
+
+					supervisor, err := ApplyPlan(plan, state.Nodes, script, dataDir, bootstrap)
+					if err != nil {
+						return err
+					}
+
+					// Keep running, supervising whatever the plan spawned or
+					// restarted, until it's shut down
+					supervisor.Wait()
+
+					return nil
+				},
+			},
+			{
+				Name:  "logs",
+				Usage: "tails the per-node log files written by a spawned swarm",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "follow",
+						Aliases: []string{"f"},
+						Usage:   "keep tailing the log file(s) for new lines as they're written",
+					},
+					&cli.Uint64Flag{
+						Name:  "node",
+						Usage: "only tail this node's log file, instead of every node's",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					// Read the configuration file from the disk
+					cfg, err := readConfig(c)
+					if err != nil {
+						return err
+					}
+
+					// The script whose logs we'll tail. Since "logs" is a generalized
+					// command, the global config, as well as the spawn config can be
+					// used for this command
+					script := cfg.Spawn
+
+					if script == nil || script.Nodes == nil {
+						// Use the config's global config
+						script = &cfg.ScriptConfig
+					}
+
+					// The directory the swarm's per-node log files were written under
+					dataDir := "."
+					if script.DataDir != nil {
+						dataDir = *script.DataDir
+					}
+
+					if !c.IsSet("node") {
+						return tailAllNodes(dataDir, c.Bool("follow"))
+					}
+
+					return NewFollower(nodeLogPath(dataDir, c.Uint64("node"))).Tail(context.Background(), os.Stdout, c.Bool("follow"))
+				},
+			},
 		},
 	}
 
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DesiredNode is a single node as called for by a .finkles.yaml
+// configuration, independent of whether it is currently running.
+type DesiredNode struct {
+	Index uint64
+	Role  string
+	Args  []string
+}
+
+// ActualNode is a single node as persisted to <DataDir>/state.json by a
+// running Supervisor: what is actually deployed, as of the last state write.
+type ActualNode struct {
+	Index     uint64
+	Role      string
+	Args      []string
+	Pid       int
+	PeerID    string
+	Multiaddr string
+}
+
+// Plan is the minimal set of changes needed to reconcile a desired
+// configuration against the actual state of a running swarm. It is a pure
+// function of (desired, actual), so it can be computed and reasoned about
+// without ever spawning smcd.
+type Plan struct {
+	Spawn   []DesiredNode // Nodes that are desired but not currently running
+	Stop    []ActualNode  // Nodes that are currently running but no longer desired
+	Restart []DesiredNode // Nodes that are running with different args than desired
+}
+
+// Empty reports whether the plan has nothing to do.
+func (p Plan) Empty() bool {
+	return len(p.Spawn) == 0 && len(p.Stop) == 0 && len(p.Restart) == 0
+}
+
+// PlanSwarm diffs a desired topology against the actual state of a running
+// swarm, returning the minimal plan to reconcile them: nodes to spawn, nodes
+// to gracefully stop, and nodes whose args changed and must be
+// rolling-restarted.
+func PlanSwarm(desired []DesiredNode, actual []ActualNode) Plan {
+	desiredByIndex := make(map[uint64]DesiredNode, len(desired))
+	for _, d := range desired {
+		desiredByIndex[d.Index] = d
+	}
+
+	actualByIndex := make(map[uint64]ActualNode, len(actual))
+	for _, a := range actual {
+		actualByIndex[a.Index] = a
+	}
+
+	var plan Plan
+
+	for _, d := range desired {
+		a, running := actualByIndex[d.Index]
+		if !running {
+			plan.Spawn = append(plan.Spawn, d)
+			continue
+		}
+
+		if !argsEqual(a.Args, d.Args) {
+			plan.Restart = append(plan.Restart, d)
+		}
+	}
+
+	for _, a := range actual {
+		if _, stillDesired := desiredByIndex[a.Index]; !stillDesired {
+			plan.Stop = append(plan.Stop, a)
+		}
+	}
+
+	sort.Slice(plan.Spawn, func(i, j int) bool { return plan.Spawn[i].Index < plan.Spawn[j].Index })
+	sort.Slice(plan.Stop, func(i, j int) bool { return plan.Stop[i].Index < plan.Stop[j].Index })
+	sort.Slice(plan.Restart, func(i, j int) bool { return plan.Restart[i].Index < plan.Restart[j].Index })
+
+	return plan
+}
+
+// argsEqual reports whether a and b contain the same args in the same order.
+func argsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// desiredNodes derives the topology called for by a ScriptConfig: node 0 is
+// always the bootstrap, and every other node up to Nodes.N is a peer, all
+// sharing the same configured args.
+func desiredNodes(cfg *ScriptConfig) []DesiredNode {
+	n := uint64(DefaultNumNodes)
+
+	var args []string
+
+	if cfg.Nodes != nil {
+		n = cfg.Nodes.N
+
+		if cfg.Nodes.Args != nil {
+			args = append(args, (*cfg.Nodes.Args)...)
+		}
+	}
+
+	nodes := make([]DesiredNode, n)
+
+	for i := uint64(0); i < n; i++ {
+		role := "peer"
+		if i == 0 {
+			role = "bootstrap"
+		}
+
+		nodes[i] = DesiredNode{Index: i, Role: role, Args: append([]string(nil), args...)}
+	}
+
+	return nodes
+}
+
+// needsRunningBootstrap reports whether executing plan would spawn or
+// restart any non-bootstrap node, which requires a running bootstrap node's
+// peer ID and multiaddr to point them at.
+func needsRunningBootstrap(plan Plan) bool {
+	for _, d := range plan.Spawn {
+		if d.Index != 0 {
+			return true
+		}
+	}
+
+	for _, d := range plan.Restart {
+		if d.Index != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// printPlan prints a human-readable summary of plan, as used by `finkles
+// apply --dry-run`.
+func printPlan(plan Plan) {
+	if plan.Empty() {
+		fmt.Println("swarm already matches the desired configuration")
+		return
+	}
+
+	for _, d := range plan.Spawn {
+		fmt.Printf("+ spawn node %d (%s)\n", d.Index, d.Role)
+	}
+
+	for _, a := range plan.Stop {
+		fmt.Printf("- stop node %d (%s, pid %d)\n", a.Index, a.Role, a.Pid)
+	}
+
+	for _, d := range plan.Restart {
+		fmt.Printf("~ restart node %d (%s)\n", d.Index, d.Role)
+	}
+}
+
+// ApplyPlan executes a reconciliation plan against a running swarm: nodes no
+// longer desired are stopped first (draining their connections), then every
+// node whose args changed is stopped, and only then are the new nodes
+// (pointed at the swarm's existing bootstrap node) and the changed nodes
+// (with their new args) started, all together. Changed nodes are not
+// restarted one at a time: all of them are down until the new supervisor
+// relaunches them. actual is the state the plan was computed against,
+// used to look up the pid of any node being stopped or restarted.
+//
+// It returns the Supervisor now managing every node the plan spawned or
+// restarted; nodes left untouched by the plan are left exactly as they were,
+// under whatever process originally spawned them.
+func ApplyPlan(plan Plan, actual []ActualNode, script *ScriptConfig, dataDir string, bootstrap ActualNode) (*Supervisor, error) {
+	if needsRunningBootstrap(plan) && bootstrap.PeerID == "" {
+		return nil, errors.New("no running bootstrap node found in state.json; run 'finkles spawn' first")
+	}
+
+	drainTimeout := 10 * time.Second
+	if script.Drain != nil {
+		var err error
+
+		drainTimeout, err = time.ParseDuration(*script.Drain)
+		if err != nil {
+			return nil, fmt.Errorf("drain: %w", err)
+		}
+	}
+
+	actualByIndex := make(map[uint64]ActualNode, len(actual))
+	for _, a := range actual {
+		actualByIndex[a.Index] = a
+	}
+
+	// Re-resolve the genesis allocation, if any, so that nodes spawned or
+	// restarted by this plan are given the same --genesis file as the rest
+	// of the swarm, rather than silently starting with no genesis block.
+	n := uint64(DefaultNumNodes)
+	if script.Nodes != nil {
+		n = script.Nodes.N
+	}
+
+	genesisPath, err := script.prepareGenesis(dataDir, n)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stop := range plan.Stop {
+		if err := stopPid(stop.Pid, drainTimeout); err != nil {
+			log.WithFields(log.Fields{"node": stop.Index}).WithError(err).Warn("failed to stop removed node")
+		}
+	}
+
+	for _, restart := range plan.Restart {
+		if current, ok := actualByIndex[restart.Index]; ok {
+			if err := stopPid(current.Pid, drainTimeout); err != nil {
+				log.WithFields(log.Fields{"node": restart.Index}).WithError(err).Warn("failed to stop changed node before restarting it")
+			}
+		}
+	}
+
+	policy := RestartOnFailure
+	var health *HealthCheck
+
+	if script.Nodes != nil {
+		if script.Nodes.Restart != nil {
+			policy = RestartPolicy(*script.Nodes.Restart)
+		}
+
+		if script.Nodes.Health != nil {
+			health = &HealthCheck{}
+
+			if script.Nodes.Health.Addr != nil {
+				health.Addr = *script.Nodes.Health.Addr
+			}
+
+			if script.Nodes.Health.Interval != nil {
+				var err error
+
+				health.Interval, err = time.ParseDuration(*script.Nodes.Health.Interval)
+				if err != nil {
+					return nil, fmt.Errorf("health: %w", err)
+				}
+			}
+		}
+	}
+
+	supervisor := NewSupervisor(dataDir, drainTimeout, nil)
+
+	toStart := append(append([]DesiredNode(nil), plan.Spawn...), plan.Restart...)
+
+	for _, node := range toStart {
+		node := node
+
+		var execArgs []string
+		if node.Index == 0 {
+			execArgs = append(execArgs, "-n", "--data-dir", nodeDataDir(dataDir, node.Index))
+		} else {
+			execArgs = append(execArgs, "--bootstrap-peer-id", bootstrap.PeerID, "--bootstrap-peer-addr", bootstrap.Multiaddr, "--data-dir", nodeDataDir(dataDir, node.Index))
+		}
+
+		execArgs = append(execArgs, node.Args...)
+
+		if genesisPath != "" {
+			execArgs = append(execArgs, "--genesis", genesisPath)
+		}
+
+		supervisor.Add(node.Index, node.Role, node.Args, policy, health, func() *exec.Cmd {
+			return exec.Command("smcd", execArgs...)
+		}, nil)
+	}
+
+	supervisor.Start()
+
+	return supervisor, nil
+}
+
+// stopPid sends SIGTERM to pid and waits up to drainTimeout for it to exit
+// before escalating to SIGKILL. Unlike Supervisor's own shutdown path, pid
+// is not necessarily a child of this process (it may belong to an earlier
+// `finkles spawn` invocation), so liveness is polled with a signal-0 probe
+// rather than Wait.
+func stopPid(pid int, drainTimeout time.Duration) error {
+	if pid == 0 {
+		return nil
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) {
+		if proc.Signal(syscall.Signal(0)) != nil {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return proc.Signal(syscall.SIGKILL)
+}
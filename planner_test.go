@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanSwarmSpawnsMissingNodes(t *testing.T) {
+	desired := []DesiredNode{
+		{Index: 0, Role: "bootstrap"},
+		{Index: 1, Role: "peer"},
+	}
+
+	plan := PlanSwarm(desired, nil)
+
+	if !reflect.DeepEqual(plan.Spawn, desired) {
+		t.Fatalf("Spawn = %+v, want %+v", plan.Spawn, desired)
+	}
+
+	if len(plan.Stop) != 0 || len(plan.Restart) != 0 {
+		t.Fatalf("expected only spawns, got %+v", plan)
+	}
+}
+
+func TestPlanSwarmStopsUndesiredNodes(t *testing.T) {
+	actual := []ActualNode{
+		{Index: 0, Role: "bootstrap", Pid: 100},
+		{Index: 1, Role: "peer", Pid: 101},
+	}
+
+	plan := PlanSwarm(nil, actual)
+
+	if !reflect.DeepEqual(plan.Stop, actual) {
+		t.Fatalf("Stop = %+v, want %+v", plan.Stop, actual)
+	}
+
+	if len(plan.Spawn) != 0 || len(plan.Restart) != 0 {
+		t.Fatalf("expected only stops, got %+v", plan)
+	}
+}
+
+func TestPlanSwarmRestartsChangedArgs(t *testing.T) {
+	desired := []DesiredNode{
+		{Index: 0, Role: "bootstrap", Args: []string{"--flag", "new"}},
+	}
+	actual := []ActualNode{
+		{Index: 0, Role: "bootstrap", Args: []string{"--flag", "old"}, Pid: 100},
+	}
+
+	plan := PlanSwarm(desired, actual)
+
+	if !reflect.DeepEqual(plan.Restart, desired) {
+		t.Fatalf("Restart = %+v, want %+v", plan.Restart, desired)
+	}
+
+	if len(plan.Spawn) != 0 || len(plan.Stop) != 0 {
+		t.Fatalf("expected only a restart, got %+v", plan)
+	}
+}
+
+func TestPlanSwarmLeavesUnchangedNodesAlone(t *testing.T) {
+	desired := []DesiredNode{
+		{Index: 0, Role: "bootstrap", Args: []string{"--flag", "same"}},
+	}
+	actual := []ActualNode{
+		{Index: 0, Role: "bootstrap", Args: []string{"--flag", "same"}, Pid: 100},
+	}
+
+	plan := PlanSwarm(desired, actual)
+
+	if !plan.Empty() {
+		t.Fatalf("expected an empty plan, got %+v", plan)
+	}
+}
+
+func TestPlanSwarmIsSortedByIndex(t *testing.T) {
+	desired := []DesiredNode{
+		{Index: 2, Role: "peer"},
+		{Index: 0, Role: "bootstrap"},
+		{Index: 1, Role: "peer"},
+	}
+
+	plan := PlanSwarm(desired, nil)
+
+	for i, node := range plan.Spawn {
+		if node.Index != uint64(i) {
+			t.Fatalf("Spawn[%d].Index = %d, want %d", i, node.Index, i)
+		}
+	}
+}
+
+func TestArgsEqual(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []string
+		want bool
+	}{
+		{"both nil", nil, nil, true},
+		{"both empty", []string{}, []string{}, true},
+		{"equal", []string{"-n", "1"}, []string{"-n", "1"}, true},
+		{"different length", []string{"-n"}, []string{"-n", "1"}, false},
+		{"different order", []string{"-n", "1"}, []string{"1", "-n"}, false},
+		{"different value", []string{"-n", "1"}, []string{"-n", "2"}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := argsEqual(tc.a, tc.b); got != tc.want {
+				t.Errorf("argsEqual(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDesiredNodesDefaultsToDefaultNumNodes(t *testing.T) {
+	nodes := desiredNodes(&ScriptConfig{})
+
+	if len(nodes) != DefaultNumNodes {
+		t.Fatalf("len(nodes) = %d, want %d", len(nodes), DefaultNumNodes)
+	}
+
+	if nodes[0].Role != "bootstrap" {
+		t.Fatalf("nodes[0].Role = %q, want bootstrap", nodes[0].Role)
+	}
+
+	for i := 1; i < len(nodes); i++ {
+		if nodes[i].Role != "peer" {
+			t.Fatalf("nodes[%d].Role = %q, want peer", i, nodes[i].Role)
+		}
+	}
+}
+
+func TestDesiredNodesHonorsConfiguredArgs(t *testing.T) {
+	args := []string{"--flag", "value"}
+	n := uint64(3)
+
+	cfg := &ScriptConfig{
+		Nodes: &struct {
+			N        uint64
+			Args     *[]string
+			Callback *string
+			Restart  *string
+			Health   *struct {
+				Addr     *string
+				Interval *string
+			}
+		}{N: n, Args: &args},
+	}
+
+	nodes := desiredNodes(cfg)
+
+	if len(nodes) != int(n) {
+		t.Fatalf("len(nodes) = %d, want %d", len(nodes), n)
+	}
+
+	for _, node := range nodes {
+		if !argsEqual(node.Args, args) {
+			t.Fatalf("nodes[%d].Args = %v, want %v", node.Index, node.Args, args)
+		}
+	}
+}
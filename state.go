@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// SwarmState is what a Supervisor persists to <DataDir>/state.json: a
+// snapshot of the currently-running topology, so that a later `finkles
+// apply` invocation (a separate process) can diff its desired configuration
+// against what is actually deployed.
+type SwarmState struct {
+	Nodes []ActualNode
+}
+
+// readSwarmState reads the swarm state persisted under dataDir. If no
+// state.json exists yet (e.g. the swarm has never been spawned), it returns
+// an empty state rather than an error.
+func readSwarmState(dataDir string) (*SwarmState, error) {
+	f, err := os.Open(filepath.Join(dataDir, "state.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &SwarmState{}, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	var state SwarmState
+
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// writeSwarmState persists the swarm's current topology to
+// <dataDir>/state.json, creating dataDir if it does not already exist.
+func writeSwarmState(dataDir string, nodes []ActualNode) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dataDir, "state.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(SwarmState{Nodes: nodes})
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RestartPolicy describes when a supervised component should be restarted
+// after its process exits.
+type RestartPolicy string
+
+const (
+	// RestartAlways restarts the component every time its process exits, regardless of exit code.
+	RestartAlways RestartPolicy = "always"
+
+	// RestartOnFailure only restarts the component when its process exits with a non-zero status.
+	RestartOnFailure RestartPolicy = "on-failure"
+
+	// RestartNever never restarts the component once its process has exited.
+	RestartNever RestartPolicy = "never"
+)
+
+// ComponentState describes the current lifecycle state of a supervised component.
+type ComponentState string
+
+const (
+	ComponentStarting  ComponentState = "starting"  // The component's process is being started
+	ComponentRunning   ComponentState = "running"   // The component's process is running and passing health checks
+	ComponentUnhealthy ComponentState = "unhealthy" // The component failed its health check; its process was killed and is awaiting a restart
+	ComponentStopped   ComponentState = "stopped"   // The component was asked to stop, and has exited
+	ComponentFailed    ComponentState = "failed"    // The component exceeded its restart budget, or its policy forbids a restart
+)
+
+// maxComponentRestarts is the number of times a component will be restarted
+// before the supervisor gives up on it and marks it failed.
+const maxComponentRestarts = 10
+
+// defaultHealthInterval is how often a component's health check is run if
+// the configuration does not specify an interval.
+const defaultHealthInterval = 10 * time.Second
+
+// ComponentStatus is a point-in-time snapshot of a component's lifecycle
+// state, returned by Supervisor.Status.
+type ComponentStatus struct {
+	Index     uint64         // The index of the node this component represents
+	Role      string         // "bootstrap" or "peer"
+	Args      []string       // The configured args this component was started with
+	Pid       int            // The PID of the component's current process, if it has one
+	PeerID    string         // The component's peer ID, once it has announced one
+	Multiaddr string         // The component's multiaddr, once it has announced one
+	State     ComponentState // The component's current lifecycle state
+	Restarts  uint64         // The number of times this component has been restarted
+}
+
+// HealthCheck describes how to determine whether a running component is
+// still healthy, independently of whether its process has died.
+type HealthCheck struct {
+	Addr     string        // A host:port (e.g. the node's multiaddr host) to dial as a TCP liveness probe
+	Interval time.Duration // How often to run the probe; defaults to defaultHealthInterval if zero
+}
+
+// component is a single smcd process supervised by a Supervisor. It knows
+// how to (re)build the command that starts it, and the policy that governs
+// whether it should be restarted after exiting.
+type component struct {
+	index    uint64
+	role     string
+	args     []string
+	build    func() *exec.Cmd
+	policy   RestartPolicy
+	health   *HealthCheck
+	onOutput func(line string)
+	onStart  func(pid int)
+	logSink  LogSink
+
+	drainTimeout time.Duration
+
+	cancel  context.CancelFunc
+	stopped chan struct{}
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	state     ComponentState
+	restarts  uint64
+	peerID    string
+	multiaddr string
+}
+
+// status returns a snapshot of the component's current lifecycle state.
+func (c *component) status() ComponentStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := ComponentStatus{
+		Index:     c.index,
+		Role:      c.role,
+		Args:      c.args,
+		State:     c.state,
+		Restarts:  c.restarts,
+		PeerID:    c.peerID,
+		Multiaddr: c.multiaddr,
+	}
+	if c.cmd != nil && c.cmd.Process != nil {
+		status.Pid = c.cmd.Process.Pid
+	}
+
+	return status
+}
+
+func (c *component) setState(state ComponentState) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+}
+
+// attachOutput pipes cmd's stdout and stderr, line by line, to whoever is
+// interested: onOutput (if set) sees stderr, and logSink (if set) sees
+// both streams tagged with this component's node, role, and pid. It is a
+// no-op if neither is configured, so components with no output consumer
+// don't pay for the extra pipes and goroutines.
+func (c *component) attachOutput(cmd *exec.Cmd) {
+	if c.onOutput == nil && c.logSink == nil {
+		return
+	}
+
+	if stderr, err := cmd.StderrPipe(); err != nil {
+		log.WithFields(log.Fields{"node": c.index, "role": c.role}).WithError(err).Error("failed to attach to component stderr")
+	} else {
+		go scanLines(stderr, func(line string) {
+			if c.onOutput != nil {
+				c.onOutput(line)
+			}
+
+			if c.logSink != nil {
+				c.logSink.Write(c.index, c.role, c.pid(), "stderr", line)
+			}
+		})
+	}
+
+	if c.logSink == nil {
+		return
+	}
+
+	if stdout, err := cmd.StdoutPipe(); err != nil {
+		log.WithFields(log.Fields{"node": c.index, "role": c.role}).WithError(err).Error("failed to attach to component stdout")
+	} else {
+		go scanLines(stdout, func(line string) {
+			c.logSink.Write(c.index, c.role, c.pid(), "stdout", line)
+		})
+	}
+}
+
+// pid returns the PID of the component's current process, or 0 if it has
+// not been started yet.
+func (c *component) pid() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cmd != nil && c.cmd.Process != nil {
+		return c.cmd.Process.Pid
+	}
+
+	return 0
+}
+
+// run drives the component's start/monitor/restart loop until ctx is
+// canceled. Each component is given its own goroutine by the Supervisor, so
+// this is free to block on the process it owns without affecting any other
+// component.
+func (c *component) run(ctx context.Context) {
+	var attempt uint64
+
+	for {
+		if ctx.Err() != nil {
+			c.setState(ComponentStopped)
+			return
+		}
+
+		c.setState(ComponentStarting)
+
+		cmd := c.build()
+
+		// Tee the component's output to whoever wants to observe it (a caller
+		// scraping the bootstrap node's stderr for its peer ID, and/or the
+		// supervisor's log sink) via dedicated goroutines, so that a slow or
+		// misbehaving consumer can never stall this component's own run loop
+		c.attachOutput(cmd)
+
+		c.mu.Lock()
+		c.cmd = cmd
+		c.mu.Unlock()
+
+		if err := cmd.Start(); err != nil {
+			log.WithFields(log.Fields{"node": c.index, "role": c.role}).WithError(err).Error("failed to start component")
+
+			if c.policy == RestartNever {
+				c.setState(ComponentFailed)
+				return
+			}
+		} else {
+			c.setState(ComponentRunning)
+
+			if c.onStart != nil {
+				c.onStart(cmd.Process.Pid)
+			}
+
+			if restart := c.waitForExitOrShutdown(ctx, cmd); !restart {
+				return
+			}
+		}
+
+		attempt++
+		if attempt > maxComponentRestarts {
+			c.setState(ComponentFailed)
+			log.WithFields(log.Fields{"node": c.index, "role": c.role}).Error("component exceeded its restart budget, giving up")
+			return
+		}
+
+		c.mu.Lock()
+		c.restarts++
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			c.setState(ComponentStopped)
+			return
+		case <-time.After(backoffWithJitter(attempt)):
+		}
+	}
+}
+
+// waitForExitOrShutdown blocks until the component's process exits, the
+// component fails its health check, or the supervisor asks it to shut down.
+// It returns true if the caller should loop around and restart the
+// component, or false if run should return.
+func (c *component) waitForExitOrShutdown(ctx context.Context, cmd *exec.Cmd) bool {
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	unhealthy := make(chan struct{}, 1)
+	healthDone := make(chan struct{})
+	defer close(healthDone)
+
+	if c.health != nil {
+		go c.watchHealth(healthDone, unhealthy)
+	}
+
+	select {
+	case <-ctx.Done():
+		if cmd.Process != nil {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+
+		select {
+		case <-exited:
+		case <-time.After(c.drainTimeout):
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+
+		c.setState(ComponentStopped)
+		return false
+
+	case <-unhealthy:
+		_ = cmd.Process.Kill()
+		<-exited
+
+		if c.policy == RestartNever {
+			log.WithFields(log.Fields{"node": c.index, "role": c.role}).Warn("component failed its health check, not restarting (policy: never)")
+			c.setState(ComponentFailed)
+			return false
+		}
+
+		log.WithFields(log.Fields{"node": c.index, "role": c.role}).Warn("component failed its health check, restarting")
+		c.setState(ComponentUnhealthy)
+		return true
+
+	case err := <-exited:
+		if err == nil && c.policy != RestartAlways {
+			c.setState(ComponentStopped)
+			return false
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{"node": c.index, "role": c.role}).WithError(err).Warn("component exited")
+		}
+
+		if c.policy == RestartNever {
+			c.setState(ComponentFailed)
+			return false
+		}
+
+		return true
+	}
+}
+
+// watchHealth periodically TCP-dials the component's health check address,
+// reporting a single unhealthy signal (and then exiting) the first time a
+// probe fails.
+func (c *component) watchHealth(done <-chan struct{}, unhealthy chan<- struct{}) {
+	if c.health.Addr == "" {
+		return
+	}
+
+	interval := c.health.Interval
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			conn, err := net.DialTimeout("tcp", c.health.Addr, interval/2)
+			if err != nil {
+				select {
+				case unhealthy <- struct{}{}:
+				default:
+				}
+				return
+			}
+
+			conn.Close()
+		}
+	}
+}
+
+// scanLines reads r line-by-line, calling fn with each line, until r is
+// exhausted.
+func scanLines(r io.Reader, fn func(string)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+}
+
+// backoffWithJitter returns an exponential backoff duration for the given
+// restart attempt (1-indexed), capped at 30s and jittered so that a crash
+// loop across many components doesn't cause them all to restart in lockstep.
+func backoffWithJitter(attempt uint64) time.Duration {
+	base := time.Second
+	for i := uint64(1); i < attempt && base < 30*time.Second; i++ {
+		base *= 2
+	}
+
+	if base > 30*time.Second {
+		base = 30 * time.Second
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(base)))
+
+	return base/2 + jitter/2
+}
+
+// Supervisor owns a set of components and drives their lifecycle: starting
+// them, restarting them according to their own policy, and shutting all of
+// them down gracefully (or killing them, after drainTimeout) when asked.
+type Supervisor struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	dataDir      string // If non-empty, where state.json is written on every topology change
+	drainTimeout time.Duration
+	logSink      LogSink                                  // If non-nil, receives every component's stdout/stderr
+	onStart      func(index uint64, role string, pid int) // If non-nil, called each time a component starts
+
+	mu         sync.Mutex
+	components []*component
+	started    bool
+
+	wg sync.WaitGroup
+}
+
+// persistInterval is how often the supervisor rewrites state.json while it
+// is running, in addition to writing it immediately after every topology
+// change (a component being added, removed, or announcing its peer info).
+const persistInterval = 2 * time.Second
+
+// NewSupervisor creates a Supervisor that gives each of its components
+// drainTimeout to shut down gracefully (via SIGTERM) before killing them. If
+// dataDir is non-empty, the supervisor persists its topology to
+// <dataDir>/state.json so that a later `finkles apply` invocation can
+// reconcile against it. If logs is non-nil, every component's stdout and
+// stderr is tagged and forwarded to it.
+func NewSupervisor(dataDir string, drainTimeout time.Duration, logs LogSink) *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Supervisor{ctx: ctx, cancel: cancel, dataDir: dataDir, drainTimeout: drainTimeout, logSink: logs}
+}
+
+// SetStartHook configures a function to be called, on its own goroutine,
+// each time any component starts (including restarts), with that
+// component's index, role, and pid. The hook is captured when a component is
+// added, so it only takes effect for components added after it is set.
+func (s *Supervisor) SetStartHook(hook func(index uint64, role string, pid int)) {
+	s.mu.Lock()
+	s.onStart = hook
+	s.mu.Unlock()
+}
+
+// Add registers a component with the supervisor. If the supervisor has
+// already been started (e.g. to wire up nodes that depend on a bootstrap
+// node's address once it becomes known), the component is launched
+// immediately; otherwise it is launched when Start is called.
+//
+// build is called each time the component is (re)started, and must return a
+// fresh, unstarted *exec.Cmd; it should close over copies of any config it
+// needs, rather than config the caller might later mutate. onOutput, if
+// non-nil, is called with each line the component writes to stderr. args is
+// recorded alongside the component purely for later reconciliation (see
+// PlanSwarm); it need not match build's exec.Cmd verbatim.
+func (s *Supervisor) Add(index uint64, role string, args []string, policy RestartPolicy, health *HealthCheck, build func() *exec.Cmd, onOutput func(line string)) {
+	s.mu.Lock()
+
+	onStart := s.onStart
+
+	c := &component{
+		index:        index,
+		role:         role,
+		args:         args,
+		build:        build,
+		policy:       policy,
+		health:       health,
+		onOutput:     onOutput,
+		logSink:      s.logSink,
+		drainTimeout: s.drainTimeout,
+		state:        ComponentStarting,
+	}
+
+	if onStart != nil {
+		// Run the hook on its own goroutine so that a slow (or hung) hook,
+		// e.g. a user-provided callback script, can never stall this
+		// component's run loop.
+		c.onStart = func(pid int) { go onStart(index, role, pid) }
+	}
+
+	s.components = append(s.components, c)
+	started := s.started
+
+	s.mu.Unlock()
+
+	if started {
+		s.launch(c)
+	}
+
+	s.persist()
+}
+
+// Done returns a channel that is closed once the component at index has
+// permanently stopped — gracefully, or because its policy forbade a restart,
+// or because it exhausted its restart budget — so a caller waiting on some
+// other signal from that component (e.g. its bootstrap address being
+// announced) can stop waiting if it is never going to come. It returns nil
+// if no such component is registered, or if it has not been launched yet.
+func (s *Supervisor) Done(index uint64) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.components {
+		if c.index == index {
+			return c.stopped
+		}
+	}
+
+	return nil
+}
+
+// Remove stops and unregisters a single component by index, giving it
+// drainTimeout to exit gracefully before it is killed. It does not affect
+// any other component, and blocks until the removed component has fully
+// stopped.
+func (s *Supervisor) Remove(index uint64) {
+	s.mu.Lock()
+
+	var target *component
+
+	kept := s.components[:0:0]
+	for _, c := range s.components {
+		if c.index == index {
+			target = c
+			continue
+		}
+
+		kept = append(kept, c)
+	}
+	s.components = kept
+
+	s.mu.Unlock()
+
+	if target == nil {
+		return
+	}
+
+	if target.cancel != nil {
+		target.cancel()
+	}
+
+	if target.stopped != nil {
+		<-target.stopped
+	}
+
+	s.persist()
+}
+
+// SetPeerInfo records the peer ID and multiaddr a component announced (e.g.
+// scraped from the bootstrap node's stderr), so that they are captured the
+// next time state is persisted.
+func (s *Supervisor) SetPeerInfo(index uint64, peerID, multiaddr string) {
+	s.mu.Lock()
+
+	var target *component
+
+	for _, c := range s.components {
+		if c.index == index {
+			target = c
+			break
+		}
+	}
+
+	s.mu.Unlock()
+
+	if target == nil {
+		return
+	}
+
+	target.mu.Lock()
+	target.peerID = peerID
+	target.multiaddr = multiaddr
+	target.mu.Unlock()
+
+	s.persist()
+}
+
+// persist writes the supervisor's current topology to state.json, if
+// persistence is enabled via dataDir. Failures are logged, not returned,
+// since a failed state write should never take down a running swarm.
+func (s *Supervisor) persist() {
+	if s.dataDir == "" {
+		return
+	}
+
+	statuses := s.Status()
+
+	nodes := make([]ActualNode, len(statuses))
+	for i, st := range statuses {
+		nodes[i] = ActualNode{
+			Index:     st.Index,
+			Role:      st.Role,
+			Args:      st.Args,
+			Pid:       st.Pid,
+			PeerID:    st.PeerID,
+			Multiaddr: st.Multiaddr,
+		}
+	}
+
+	if err := writeSwarmState(s.dataDir, nodes); err != nil {
+		log.WithError(err).Warn("failed to persist swarm state")
+	}
+}
+
+// persistLoop periodically rewrites state.json for as long as the
+// supervisor is running, so that a node's pid is captured even between the
+// topology changes that trigger an immediate persist.
+func (s *Supervisor) persistLoop() {
+	ticker := time.NewTicker(persistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.persist()
+		}
+	}
+}
+
+// Start launches every component registered so far in its own goroutine,
+// and begins fanning SIGINT/SIGTERM out to them, so that a Ctrl-C (or a
+// `kill`) drains the whole swarm instead of leaving orphaned smcd processes
+// behind. Components added after Start is called are launched as soon as
+// they're added.
+func (s *Supervisor) Start() {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return
+	}
+
+	s.started = true
+	components := append([]*component(nil), s.components...)
+	s.mu.Unlock()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-sigCh:
+			log.Info("received shutdown signal, draining supervised nodes")
+			s.Stop()
+		case <-s.ctx.Done():
+		}
+	}()
+
+	for _, c := range components {
+		s.launch(c)
+	}
+
+	if s.dataDir != "" {
+		go s.persistLoop()
+	}
+}
+
+// launch runs a single component's lifecycle loop in its own goroutine,
+// under a context derived from the supervisor's so that Remove can stop
+// this one component without affecting any other.
+func (s *Supervisor) launch(c *component) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	c.cancel = cancel
+	c.stopped = make(chan struct{})
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		defer close(c.stopped)
+		c.run(ctx)
+	}()
+}
+
+// Wait blocks until every supervised component has stopped, then closes the
+// log sink (if it was given one that supports closing), so that per-node
+// log files are flushed and closed rather than left open for the life of
+// the process.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+
+	if closer, ok := s.logSink.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.WithError(err).Warn("failed to close log sink")
+		}
+	}
+}
+
+// Stop asks every supervised component to shut down, giving each one
+// drainTimeout to exit gracefully before it is killed. It does not block
+// until they've exited; call Wait for that.
+func (s *Supervisor) Stop() {
+	s.cancel()
+}
+
+// Status returns a snapshot of every supervised component's lifecycle state.
+func (s *Supervisor) Status() []ComponentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]ComponentStatus, len(s.components))
+	for i, c := range s.components {
+		statuses[i] = c.status()
+	}
+
+	return statuses
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestBackoffWithJitterStaysWithinOneAttemptsBase(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		d := backoffWithJitter(1)
+		if d < 500*time.Millisecond || d >= time.Second {
+			t.Fatalf("backoffWithJitter(1) = %s, want [500ms, 1s)", d)
+		}
+	}
+}
+
+func TestBackoffWithJitterDoublesPerAttempt(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		d := backoffWithJitter(2)
+		if d < time.Second || d >= 2*time.Second {
+			t.Fatalf("backoffWithJitter(2) = %s, want [1s, 2s)", d)
+		}
+	}
+}
+
+func TestBackoffWithJitterCapsAt30Seconds(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		d := backoffWithJitter(100)
+		if d < 15*time.Second || d > 30*time.Second {
+			t.Fatalf("backoffWithJitter(100) = %s, want [15s, 30s]", d)
+		}
+	}
+}
+
+func TestBackoffWithJitterHandlesZeroAttempt(t *testing.T) {
+	// attempt is 1-indexed, but a caller passing 0 (e.g. before any restart
+	// has happened) should still get a sane, non-negative backoff rather
+	// than a panic or a zero/negative duration.
+	d := backoffWithJitter(0)
+	if d <= 0 {
+		t.Fatalf("backoffWithJitter(0) = %s, want > 0", d)
+	}
+}
+
+// runComponent starts c.run in its own goroutine and returns a channel that
+// is closed once it returns, so tests can assert on how long a component
+// takes to settle without blocking forever if that assumption is wrong.
+func runComponent(ctx context.Context, c *component) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.run(ctx)
+	}()
+
+	return done
+}
+
+func TestComponentRunNeverRestartsAfterAFailedStart(t *testing.T) {
+	c := &component{
+		policy:       RestartNever,
+		drainTimeout: time.Second,
+		build:        func() *exec.Cmd { return exec.Command("/nonexistent/finkles-test-binary") },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	select {
+	case <-runComponent(ctx, c):
+	case <-time.After(2 * time.Second):
+		t.Fatal("run() kept restarting a component whose process failed to start despite a never policy")
+	}
+
+	if got := c.status().State; got != ComponentFailed {
+		t.Fatalf("status.State = %s, want %s", got, ComponentFailed)
+	}
+
+	if got := c.status().Restarts; got != 0 {
+		t.Fatalf("status.Restarts = %d, want 0", got)
+	}
+}
+
+func TestComponentRunNeverRestartsAnUnhealthyComponent(t *testing.T) {
+	c := &component{
+		policy:       RestartNever,
+		health:       &HealthCheck{Addr: "127.0.0.1:1", Interval: 20 * time.Millisecond},
+		drainTimeout: time.Second,
+		build:        func() *exec.Cmd { return exec.Command("sleep", "5") },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	select {
+	case <-runComponent(ctx, c):
+	case <-time.After(2 * time.Second):
+		t.Fatal("run() kept restarting an unhealthy component despite a never policy")
+	}
+
+	if got := c.status().State; got != ComponentFailed {
+		t.Fatalf("status.State = %s, want %s", got, ComponentFailed)
+	}
+}
+
+func TestComponentRunRestartsAnUnhealthyComponentOnFailure(t *testing.T) {
+	c := &component{
+		policy:       RestartOnFailure,
+		health:       &HealthCheck{Addr: "127.0.0.1:1", Interval: 20 * time.Millisecond},
+		drainTimeout: time.Second,
+		build:        func() *exec.Cmd { return exec.Command("sleep", "5") },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := runComponent(ctx, c)
+
+	deadline := time.After(3 * time.Second)
+	for c.status().Restarts == 0 {
+		select {
+		case <-deadline:
+			cancel()
+			t.Fatal("component was never restarted despite an on-failure policy")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("run() did not return after being canceled")
+	}
+}
+
+func TestComponentRunStopsGracefullyOnCancelWithoutRestarting(t *testing.T) {
+	c := &component{
+		policy:       RestartAlways,
+		drainTimeout: time.Second,
+		build:        func() *exec.Cmd { return exec.Command("sleep", "5") },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := runComponent(ctx, c)
+
+	// Give the component a moment to actually start before asking it to stop.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("run() did not return after a graceful stop")
+	}
+
+	if got := c.status().State; got != ComponentStopped {
+		t.Fatalf("status.State = %s, want %s", got, ComponentStopped)
+	}
+}